@@ -0,0 +1,72 @@
+/*
+Copyright 2019 The KubeMacPool Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MacPoolSpec defines a named range of mac addresses to hand out to the virtual machines and
+// pods it selects, instead of falling back to the cluster-wide range kubemacpool is started
+// with.
+type MacPoolSpec struct {
+	// RangeStart is the first mac address of this pool's range, inclusive.
+	RangeStart string `json:"rangeStart"`
+
+	// RangeEnd is the last mac address of this pool's range, inclusive.
+	RangeEnd string `json:"rangeEnd"`
+
+	// NamespaceSelector restricts this pool to virtual machines and pods created in namespaces
+	// matching this selector. A nil selector matches every namespace.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// VMSelector restricts this pool to virtual machines matching this selector. A nil selector
+	// matches every virtual machine.
+	// +optional
+	VMSelector *metav1.LabelSelector `json:"vmSelector,omitempty"`
+}
+
+// MacPoolStatus reflects the observed state of a MacPool.
+type MacPoolStatus struct {
+	// AllocatedMacs is the number of mac addresses currently handed out from this pool's range.
+	// +optional
+	AllocatedMacs int32 `json:"allocatedMacs,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+
+// MacPool lets cluster admins carve a sub-range of mac addresses out for a set of namespaces
+// and/or virtual machines, so multi-tenant clusters can give e.g. dev and prod namespaces
+// disjoint OUIs without restarting the kubemacpool deployment.
+type MacPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MacPoolSpec   `json:"spec,omitempty"`
+	Status MacPoolStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// MacPoolList contains a list of MacPool.
+type MacPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MacPool `json:"items"`
+}
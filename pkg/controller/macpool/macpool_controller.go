@@ -0,0 +1,85 @@
+/*
+Copyright 2019 The KubeMacPool Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package macpool
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	kubemacpoolv1alpha1 "github.com/k8snetworkplumbingwg/kubemacpool/pkg/apis/kubemacpool/v1alpha1"
+	"github.com/k8snetworkplumbingwg/kubemacpool/pkg/pool-manager"
+)
+
+var log = logf.Log.WithName("controller_macpool")
+
+// Add creates a new MacPool controller and adds it to mgr, keeping poolManager's sub-pools in
+// sync with the MacPool objects defined in the cluster.
+func Add(mgr manager.Manager, poolManager *pool_manager.PoolManager) error {
+	r := &ReconcileMacPool{client: mgr.GetClient(), poolManager: poolManager}
+
+	c, err := controller.New("macpool-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return errors.Wrap(err, "failed to create macpool controller")
+	}
+
+	if err := c.Watch(&source.Kind{Type: &kubemacpoolv1alpha1.MacPool{}}, &handler.EnqueueRequestForObject{}); err != nil {
+		return errors.Wrap(err, "failed to watch MacPool objects")
+	}
+
+	return nil
+}
+
+// ReconcileMacPool keeps the in-memory sub-pools held by poolManager up to date with the
+// MacPool objects defined in the cluster.
+type ReconcileMacPool struct {
+	client      client.Client
+	poolManager *pool_manager.PoolManager
+}
+
+// Reconcile registers or unregisters the MacPool named in request with poolManager, so
+// SelectPoolFor and SelectPoolForPod, and through them allocation and validation, pick up the
+// change on the very next request.
+func (r *ReconcileMacPool) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Name", request.Name)
+	reqLogger.Info("reconciling MacPool")
+
+	macPool := &kubemacpoolv1alpha1.MacPool{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, macPool)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			r.poolManager.UnregisterMacPool(request.Name)
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, errors.Wrap(err, "failed to get MacPool")
+	}
+
+	if err := r.poolManager.RegisterMacPool(macPool); err != nil {
+		reqLogger.Error(err, "failed to register MacPool with the pool manager")
+		return reconcile.Result{}, err
+	}
+
+	return reconcile.Result{}, nil
+}
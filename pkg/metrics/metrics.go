@@ -0,0 +1,106 @@
+/*
+Copyright 2019 The KubeMacPool Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics registers the Prometheus collectors kubemacpool exposes for mac allocation
+// decisions, so operators can answer questions like how many macs are in use, how often
+// allocations fail and why, and how many virtual machines are still waiting on one.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Event reasons emitted on Pod/VirtualMachine objects alongside the metrics below, so
+// `kubectl describe` shows the mac lifecycle without needing to query Prometheus.
+const (
+	ReasonMacAllocated = "MacAddressAllocated"
+	ReasonMacReleased  = "MacAddressReleased"
+	ReasonMacConflict  = "MacAddressAllocationFailed"
+)
+
+var (
+	AllocatedMacs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kubemacpool_allocated_macs",
+		Help: "Number of mac addresses currently allocated by kubemacpool",
+	})
+
+	PoolSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kubemacpool_pool_size",
+		Help: "Total number of mac addresses available across the configured range(s)",
+	})
+
+	AllocationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "kubemacpool_allocation_duration_seconds",
+		Help:    "Time it took to allocate a mac address for a pod or virtual machine interface",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	AllocationFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubemacpool_allocation_failures_total",
+		Help: "Number of mac address allocation failures, by reason",
+	}, []string{"reason"})
+
+	// WaitingVMs tracks virtual machines whose mac allocation is deferred until their first pod
+	// is scheduled. Nothing in this tree currently maintains that bookkeeping (it lives in the
+	// core pool manager reconciliation loop, which this trimmed checkout doesn't contain), so the
+	// gauge is registered but not yet set anywhere.
+	WaitingVMs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kubemacpool_waiting_vms",
+		Help: "Number of virtual machines waiting for a pod event before their mac addresses are allocated",
+	})
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(AllocatedMacs, PoolSize, AllocationDuration, AllocationFailuresTotal, WaitingVMs)
+}
+
+// ObserveAllocationDuration records how long an allocation took, measured from start.
+func ObserveAllocationDuration(start time.Time) {
+	AllocationDuration.Observe(time.Since(start).Seconds())
+}
+
+// IncAllocationFailure increments the allocation failure counter for the given reason, e.g.
+// "Conflict", "OutOfRange", "Malformed" or "InternalError".
+func IncAllocationFailure(reason string) {
+	AllocationFailuresTotal.WithLabelValues(reason).Inc()
+}
+
+// SetAllocatedMacs records the exact number of mac addresses currently held in the pool. Callers
+// pass len(macPoolMap) right after mutating it, rather than calling Inc/Dec at each individual
+// call site, so a missed decrement on some code path can't leave the gauge permanently drifted
+// from the map it mirrors.
+func SetAllocatedMacs(n int) {
+	AllocatedMacs.Set(float64(n))
+}
+
+// SetPoolSize records the total number of mac addresses available across the cluster-wide range
+// and every registered MacPool range.
+func SetPoolSize(size float64) {
+	PoolSize.Set(size)
+}
+
+// Handler returns the http.Handler that serves the collectors registered in this package (and
+// anything else registered against ctrlmetrics.Registry) in the Prometheus exposition format.
+// Callers mount it at "/metrics" on whatever server already terminates kubemacpool's webhook
+// TLS listener; this checkout has no such bootstrap file, so nothing mounts it yet.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(ctrlmetrics.Registry, promhttp.HandlerOpts{})
+}
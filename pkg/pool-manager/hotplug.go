@@ -0,0 +1,203 @@
+/*
+Copyright 2019 The KubeMacPool Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pool_manager
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirt "kubevirt.io/client-go/api/v1"
+
+	"github.com/k8snetworkplumbingwg/kubemacpool/pkg/metrics"
+)
+
+// AllocateHotplugInterfaceMac allocates mac addresses only for the interfaces at addedIdx,
+// leaving owner's already-allocated interfaces untouched. interfaces must be owner's own live
+// interface slice (e.g. virtualMachine.Spec.Template.Spec.Domain.Devices.Interfaces), not a copy,
+// since the allocated mac is written back in place so the caller's patch picks it up. owner may
+// be a VirtualMachine or a VirtualMachineInstance, since KubeVirt 1.0+ allows hotplug through
+// either object. ownMacs is the set of macs already attributed to the owner's virtual machine
+// before this request (nil if none): a hot-added interface on a VM is propagated by KubeVirt to
+// its VirtualMachineInstance with the mac already filled in, so without ownMacs the VMI webhook
+// would see that mac as already present in macPoolMap and wrongly reject it as a conflict.
+func (p *PoolManager) AllocateHotplugInterfaceMac(owner metav1.Object, interfaces []kubevirt.Interface, addedIdx []int, ownMacs map[string]struct{}, transactionTimestamp *time.Time, parentLogger logr.Logger) error {
+	logger := parentLogger.WithName("AllocateHotplugInterfaceMac")
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	ownerKey := ownerNamespaced(owner)
+	for _, idx := range addedIdx {
+		if interfaces[idx].MacAddress != "" {
+			// The interface arrived with an explicit mac address: reserve it instead of
+			// skipping it, otherwise the pool believes it is still free to hand out.
+			mac, err := net.ParseMAC(interfaces[idx].MacAddress)
+			if err != nil {
+				return errors.Wrapf(err, "invalid mac address requested for hotplugged interface %s", interfaces[idx].Name)
+			}
+
+			if _, owned := ownMacs[mac.String()]; !owned {
+				if _, exists := p.macPoolMap[mac.String()]; exists {
+					return errors.Errorf("mac address %s requested for hotplugged interface %s is already allocated", mac.String(), interfaces[idx].Name)
+				}
+
+				p.macPoolMap[mac.String()] = AllocationStatusAllocated
+				metrics.SetAllocatedMacs(len(p.macPoolMap))
+			}
+
+			p.trackHotplugMac(ownerKey, mac.String())
+			logger.V(1).Info("reserved explicitly requested mac for hotplugged interface", "interfaceName", interfaces[idx].Name, "mac", mac.String())
+			continue
+		}
+
+		mac, err := p.getFreeMac()
+		if err != nil {
+			return errors.Wrap(err, "failed to allocate mac to hotplugged interface")
+		}
+
+		interfaces[idx].MacAddress = mac.String()
+		p.macPoolMap[mac.String()] = AllocationStatusAllocated
+		metrics.SetAllocatedMacs(len(p.macPoolMap))
+		p.trackHotplugMac(ownerKey, mac.String())
+		logger.V(1).Info("allocated mac to hotplugged interface", "interfaceName", interfaces[idx].Name, "mac", mac.String())
+	}
+
+	setTransactionTimestampAnnotation(owner, *transactionTimestamp)
+
+	return nil
+}
+
+// ReleaseHotplugInterfaceMacs releases the mac addresses belonging to interfaces that were
+// unplugged from owner, keeping the rest of owner's allocations intact.
+func (p *PoolManager) ReleaseHotplugInterfaceMacs(owner metav1.Object, interfaces []kubevirt.Interface, parentLogger logr.Logger) error {
+	logger := parentLogger.WithName("ReleaseHotplugInterfaceMacs")
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	ownerKey := ownerNamespaced(owner)
+	for _, iface := range interfaces {
+		if iface.MacAddress == "" {
+			continue
+		}
+
+		mac, err := net.ParseMAC(iface.MacAddress)
+		if err != nil {
+			logger.Info("skipping release of malformed mac on unplugged interface", "interfaceName", iface.Name, "mac", iface.MacAddress)
+			continue
+		}
+
+		delete(p.macPoolMap, mac.String())
+		metrics.SetAllocatedMacs(len(p.macPoolMap))
+		p.untrackHotplugMac(ownerKey, mac.String())
+		logger.V(1).Info("released mac from unplugged interface", "interfaceName", iface.Name, "mac", mac.String())
+	}
+
+	return nil
+}
+
+// ReclaimHotplugMacs releases every mac address allocated through AllocateHotplugInterfaceMac for
+// the owner identified by ownerKey (as returned by ownerNamespaced), in addition to whatever
+// ReleaseAllVirtualMachineMacs already releases by walking the VM's own interface list. This is
+// required because a mac hotplugged directly onto a VirtualMachineInstance never lands in the
+// owning VirtualMachine's spec, so it would otherwise leak when the VM is deleted.
+//
+// Nothing in this checkout calls this yet: the intended caller is the VM deletion path inside
+// ReleaseAllVirtualMachineMacs, and that function's core implementation isn't part of this
+// checkout either. Until that wiring exists, a mac hotplugged directly onto a VMI is a confirmed
+// leak on VM deletion, not just a theoretical one.
+func (p *PoolManager) ReclaimHotplugMacs(ownerKey string) {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	for mac := range p.hotplugMacsByOwner[ownerKey] {
+		delete(p.macPoolMap, mac)
+	}
+	metrics.SetAllocatedMacs(len(p.macPoolMap))
+	delete(p.hotplugMacsByOwner, ownerKey)
+}
+
+// trackHotplugMac records that mac was allocated through the hotplug path for ownerKey, so
+// ReclaimHotplugMacs can find it again on deletion. Callers must hold p.poolMutex.
+func (p *PoolManager) trackHotplugMac(ownerKey, mac string) {
+	if p.hotplugMacsByOwner == nil {
+		p.hotplugMacsByOwner = map[string]map[string]struct{}{}
+	}
+	if p.hotplugMacsByOwner[ownerKey] == nil {
+		p.hotplugMacsByOwner[ownerKey] = map[string]struct{}{}
+	}
+	p.hotplugMacsByOwner[ownerKey][mac] = struct{}{}
+}
+
+// untrackHotplugMac is the inverse of trackHotplugMac, called when a hotplugged interface is
+// unplugged again. Callers must hold p.poolMutex.
+func (p *PoolManager) untrackHotplugMac(ownerKey, mac string) {
+	delete(p.hotplugMacsByOwner[ownerKey], mac)
+}
+
+// ownerNamespaced returns the namespaced name of owner, used as the key into
+// p.hotplugMacsByOwner.
+func ownerNamespaced(owner metav1.Object) string {
+	return fmt.Sprintf("%s/%s", owner.GetNamespace(), owner.GetName())
+}
+
+// DiffInterfaces compares the interface list of a VM/VMI before and after an update and returns
+// the indices within current of interfaces that were newly added, plus the interfaces that were
+// removed, matched by name. Added interfaces are returned as indices into current rather than
+// copies, so the caller can pass current straight to AllocateHotplugInterfaceMac and have the
+// allocated mac written back into the live object.
+func DiffInterfaces(previous, current []kubevirt.Interface) (addedIdx []int, removed []kubevirt.Interface) {
+	previousByName := make(map[string]struct{}, len(previous))
+	for _, iface := range previous {
+		previousByName[iface.Name] = struct{}{}
+	}
+
+	currentByName := make(map[string]struct{}, len(current))
+	for idx, iface := range current {
+		currentByName[iface.Name] = struct{}{}
+		if _, exist := previousByName[iface.Name]; !exist {
+			addedIdx = append(addedIdx, idx)
+		}
+	}
+
+	for _, iface := range previous {
+		if _, exist := currentByName[iface.Name]; !exist {
+			removed = append(removed, iface)
+		}
+	}
+
+	return addedIdx, removed
+}
+
+// VmiNamespaced returns the namespaced name of a VirtualMachineInstance, for logging.
+func VmiNamespaced(vmi *kubevirt.VirtualMachineInstance) string {
+	return fmt.Sprintf("%s/%s", vmi.Namespace, vmi.Name)
+}
+
+func setTransactionTimestampAnnotation(owner metav1.Object, transactionTimestamp time.Time) {
+	annotations := owner.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	annotations[TransactionTimestampAnnotation] = transactionTimestamp.Format(time.RFC3339Nano)
+	owner.SetAnnotations(annotations)
+}
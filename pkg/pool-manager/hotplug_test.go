@@ -0,0 +1,87 @@
+/*
+Copyright 2019 The KubeMacPool Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pool_manager
+
+import (
+	"reflect"
+	"testing"
+
+	kubevirt "kubevirt.io/client-go/api/v1"
+)
+
+// AllocateHotplugInterfaceMac, ReleaseHotplugInterfaceMacs and ReclaimHotplugMacs are all methods
+// on *PoolManager, whose struct is not defined anywhere in this checkout (it lives in the core
+// pool manager file, which this trimmed tree doesn't contain), so they cannot be exercised here.
+// DiffInterfaces is a free function and is the only part of this file that can be unit tested in
+// isolation.
+func TestDiffInterfaces(t *testing.T) {
+	cases := []struct {
+		name         string
+		previous     []kubevirt.Interface
+		current      []kubevirt.Interface
+		wantAddedIdx []int
+		wantRemoved  []kubevirt.Interface
+	}{
+		{
+			name:         "no change",
+			previous:     []kubevirt.Interface{{Name: "net1", MacAddress: "aa:aa:aa:aa:aa:aa"}},
+			current:      []kubevirt.Interface{{Name: "net1", MacAddress: "aa:aa:aa:aa:aa:aa"}},
+			wantAddedIdx: nil,
+			wantRemoved:  nil,
+		},
+		{
+			name:         "interface added",
+			previous:     []kubevirt.Interface{{Name: "net1"}},
+			current:      []kubevirt.Interface{{Name: "net1"}, {Name: "net2"}},
+			wantAddedIdx: []int{1},
+			wantRemoved:  nil,
+		},
+		{
+			name:         "interface removed",
+			previous:     []kubevirt.Interface{{Name: "net1"}, {Name: "net2", MacAddress: "bb:bb:bb:bb:bb:bb"}},
+			current:      []kubevirt.Interface{{Name: "net1"}},
+			wantAddedIdx: nil,
+			wantRemoved:  []kubevirt.Interface{{Name: "net2", MacAddress: "bb:bb:bb:bb:bb:bb"}},
+		},
+		{
+			name:         "interface added and removed in the same update",
+			previous:     []kubevirt.Interface{{Name: "net1"}},
+			current:      []kubevirt.Interface{{Name: "net2"}},
+			wantAddedIdx: []int{0},
+			wantRemoved:  []kubevirt.Interface{{Name: "net1"}},
+		},
+		{
+			name:         "empty previous and current",
+			previous:     nil,
+			current:      nil,
+			wantAddedIdx: nil,
+			wantRemoved:  nil,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addedIdx, removed := DiffInterfaces(c.previous, c.current)
+			if !reflect.DeepEqual(addedIdx, c.wantAddedIdx) {
+				t.Errorf("addedIdx = %v, want %v", addedIdx, c.wantAddedIdx)
+			}
+			if !reflect.DeepEqual(removed, c.wantRemoved) {
+				t.Errorf("removed = %v, want %v", removed, c.wantRemoved)
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+/*
+Copyright 2019 The KubeMacPool Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pool_manager
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubevirt "kubevirt.io/client-go/api/v1"
+
+	kubemacpoolv1alpha1 "github.com/k8snetworkplumbingwg/kubemacpool/pkg/apis/kubemacpool/v1alpha1"
+	"github.com/k8snetworkplumbingwg/kubemacpool/pkg/metrics"
+)
+
+// subPool is the in-memory counterpart of a MacPool object: a named range of mac addresses
+// restricted to the namespaces and virtual machines (or pods) it selects. Allocation and
+// validation consult p.subPools through SelectPoolFor/SelectPoolForPod before falling back to the
+// cluster-wide p.rangeStart/p.rangeEnd.
+type subPool struct {
+	rangeStart        net.HardwareAddr
+	rangeEnd          net.HardwareAddr
+	namespaceSelector labels.Selector
+	vmSelector        labels.Selector
+}
+
+// RegisterMacPool adds or replaces the sub-pool backing macPool, so the very next allocation or
+// validation picks it up. Called by the macpool controller whenever a MacPool object is added or
+// updated.
+func (p *PoolManager) RegisterMacPool(macPool *kubemacpoolv1alpha1.MacPool) error {
+	rangeStart, err := net.ParseMAC(macPool.Spec.RangeStart)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse rangeStart of MacPool %s", macPool.Name)
+	}
+
+	rangeEnd, err := net.ParseMAC(macPool.Spec.RangeEnd)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse rangeEnd of MacPool %s", macPool.Name)
+	}
+
+	// A nil selector matches everything, whereas LabelSelectorAsSelector(nil) matches nothing.
+	namespaceSelector := labels.Everything()
+	if macPool.Spec.NamespaceSelector != nil {
+		namespaceSelector, err = metav1.LabelSelectorAsSelector(macPool.Spec.NamespaceSelector)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse namespaceSelector of MacPool %s", macPool.Name)
+		}
+	}
+
+	vmSelector := labels.Everything()
+	if macPool.Spec.VMSelector != nil {
+		vmSelector, err = metav1.LabelSelectorAsSelector(macPool.Spec.VMSelector)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse vmSelector of MacPool %s", macPool.Name)
+		}
+	}
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	p.subPools[macPool.Name] = &subPool{
+		rangeStart:        rangeStart,
+		rangeEnd:          rangeEnd,
+		namespaceSelector: namespaceSelector,
+		vmSelector:        vmSelector,
+	}
+	p.recalculatePoolSize()
+
+	return nil
+}
+
+// UnregisterMacPool removes the sub-pool backing the MacPool named name, so the namespaces and
+// virtual machines it used to select fall back to the cluster-wide range on the next allocation
+// or validation. Called by the macpool controller when the MacPool object is deleted.
+func (p *PoolManager) UnregisterMacPool(name string) {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	delete(p.subPools, name)
+	p.recalculatePoolSize()
+}
+
+// recalculatePoolSize refreshes the PoolSize gauge to reflect the cluster-wide range plus every
+// registered MacPool range. Callers must hold p.poolMutex.
+func (p *PoolManager) recalculatePoolSize() {
+	size := new(big.Int).Add(macRangeSize(p.rangeStart, p.rangeEnd), big.NewInt(1))
+	for _, pool := range p.subPools {
+		size.Add(size, new(big.Int).Add(macRangeSize(pool.rangeStart, pool.rangeEnd), big.NewInt(1)))
+	}
+
+	metrics.SetPoolSize(float64(size.Int64()))
+}
+
+// SelectPoolFor returns the narrowest registered sub-pool that selects vm's namespace and
+// labels, or nil if none does, in which case the caller should fall back to the cluster-wide
+// range. An error means the namespace lookup itself failed and the caller must not guess.
+func (p *PoolManager) SelectPoolFor(vm *kubevirt.VirtualMachine) (*subPool, error) {
+	return p.selectPool(vm.Namespace, vm.Labels)
+}
+
+// SelectPoolForPod is the pod equivalent of SelectPoolFor: it returns the narrowest registered
+// sub-pool that selects pod's namespace and labels, or nil if none does, in which case the caller
+// should fall back to the cluster-wide range. An error means the namespace lookup itself failed
+// and the caller must not guess.
+func (p *PoolManager) SelectPoolForPod(pod *corev1.Pod) (*subPool, error) {
+	return p.selectPool(pod.Namespace, pod.Labels)
+}
+
+// selectPool returns the narrowest registered sub-pool whose namespaceSelector matches the
+// namespace named namespace and whose vmSelector matches objLabels, or nil if none does. A
+// transient error fetching the namespace is returned rather than silently treated as "no
+// sub-pool selects this object", since that would mis-allocate/mis-validate against the
+// cluster-wide range instead of the sub-pool the caller should actually have used.
+//
+// This does an uncached read on every call; moving to a namespace lister/informer cache would
+// avoid the per-request API round trip, but this checkout has no place to wire one up.
+func (p *PoolManager) selectPool(namespace string, objLabels map[string]string) (*subPool, error) {
+	namespaceObj, err := p.kubeClient.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get namespace %s", namespace)
+	}
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	var narrowest *subPool
+	for _, pool := range p.subPools {
+		if !pool.namespaceSelector.Matches(labels.Set(namespaceObj.Labels)) {
+			continue
+		}
+		if !pool.vmSelector.Matches(labels.Set(objLabels)) {
+			continue
+		}
+		if narrowest == nil || macRangeSize(pool.rangeStart, pool.rangeEnd).Cmp(macRangeSize(narrowest.rangeStart, narrowest.rangeEnd)) < 0 {
+			narrowest = pool
+		}
+	}
+
+	return narrowest, nil
+}
+
+// macRangeSize returns end minus start, one less than the number of addresses in the [start, end]
+// range, used by selectPool to pick the narrowest of several pools that select the same object.
+func macRangeSize(start, end net.HardwareAddr) *big.Int {
+	return new(big.Int).Sub(new(big.Int).SetBytes(end), new(big.Int).SetBytes(start))
+}
+
+// getFreeMacInRange returns the first unallocated mac address in [rangeStart, rangeEnd]. It is the
+// MacPool-scoped counterpart of getFreeMac, which only ever searches the cluster-wide range.
+// Callers must hold p.poolMutex.
+func (p *PoolManager) getFreeMacInRange(rangeStart, rangeEnd net.HardwareAddr) (net.HardwareAddr, error) {
+	current := make(net.HardwareAddr, len(rangeStart))
+	copy(current, rangeStart)
+
+	for macInRange(current, rangeStart, rangeEnd) {
+		if _, exists := p.macPoolMap[current.String()]; !exists {
+			return current, nil
+		}
+		incrementMac(current)
+	}
+
+	return nil, errors.New("no free mac addresses left in the MacPool range")
+}
+
+// incrementMac adds one to mac, treating it as a big-endian number, so getFreeMacInRange can walk
+// a range one address at a time.
+func incrementMac(mac net.HardwareAddr) {
+	for i := len(mac) - 1; i >= 0; i-- {
+		mac[i]++
+		if mac[i] != 0 {
+			return
+		}
+	}
+}
+
+// AllocateVirtualMachineMacFromPool allocates mac addresses for virtualMachine's interfaces that
+// don't already request one, from pool's range instead of the cluster-wide one. Callers use it
+// instead of AllocateVirtualMachineMac once SelectPoolFor found a pool that selects
+// virtualMachine, so the MacPool's own range is honoured rather than the global one.
+func (p *PoolManager) AllocateVirtualMachineMacFromPool(virtualMachine *kubevirt.VirtualMachine, pool *subPool, transactionTimestamp *time.Time, parentLogger logr.Logger) error {
+	logger := parentLogger.WithName("AllocateVirtualMachineMacFromPool")
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	interfaces := virtualMachine.Spec.Template.Spec.Domain.Devices.Interfaces
+	for idx := range interfaces {
+		if interfaces[idx].MacAddress != "" {
+			continue
+		}
+
+		mac, err := p.getFreeMacInRange(pool.rangeStart, pool.rangeEnd)
+		if err != nil {
+			return errors.Wrap(err, "failed to allocate mac from MacPool")
+		}
+
+		interfaces[idx].MacAddress = mac.String()
+		p.macPoolMap[mac.String()] = AllocationStatusAllocated
+		metrics.SetAllocatedMacs(len(p.macPoolMap))
+		logger.V(1).Info("allocated mac from MacPool", "interfaceName", interfaces[idx].Name, "mac", mac.String())
+	}
+
+	SetTransactionTimestampAnnotationToVm(virtualMachine, *transactionTimestamp)
+
+	return nil
+}
+
+// AllocatePodMacFromPool is the pod equivalent of AllocateVirtualMachineMacFromPool: it allocates
+// mac addresses, from pool's range instead of the cluster-wide one, for every multus network
+// element on pod's network annotation that doesn't already request one. Callers use it instead of
+// AllocatePodMac once SelectPoolForPod found a pool that selects pod.
+//
+// Like parsePodRequestedMacs, an annotation that isn't a JSON array (the multus short form,
+// "net1,ns/net2") is left untouched rather than rejected, since that form can't carry a mac
+// address to fill in anyway.
+//
+// Unlike the core allocation path, this commits macs to p.macPoolMap directly instead of going
+// through its waiting-for-commit transaction lifecycle, so a mac allocated here can leak if the
+// pod's create is ultimately rejected by a later admission webhook. Reproducing that lifecycle
+// needs the core pool manager's transaction bookkeeping, which isn't part of this checkout.
+func (p *PoolManager) AllocatePodMacFromPool(pod *corev1.Pod, pool *subPool) error {
+	rawNetworks, ok := pod.Annotations[NetworksAnnotation]
+	if !ok || rawNetworks == "" {
+		return nil
+	}
+
+	var networks []map[string]interface{}
+	if err := json.Unmarshal([]byte(rawNetworks), &networks); err != nil {
+		return nil
+	}
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	changed := false
+	for i := range networks {
+		if mac, ok := networks[i]["mac"].(string); ok && mac != "" {
+			continue
+		}
+
+		mac, err := p.getFreeMacInRange(pool.rangeStart, pool.rangeEnd)
+		if err != nil {
+			return errors.Wrap(err, "failed to allocate mac from MacPool")
+		}
+
+		networks[i]["mac"] = mac.String()
+		p.macPoolMap[mac.String()] = AllocationStatusAllocated
+		metrics.SetAllocatedMacs(len(p.macPoolMap))
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	updatedNetworks, err := json.Marshal(networks)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal pod network annotation")
+	}
+
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[NetworksAnnotation] = string(updatedNetworks)
+
+	return nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2019 The KubeMacPool Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pool_manager
+
+import (
+	"net"
+	"testing"
+)
+
+// selectPool, SelectPoolFor, SelectPoolForPod, getFreeMacInRange, AllocateVirtualMachineMacFromPool
+// and AllocatePodMacFromPool are all methods on *PoolManager, whose struct is not defined anywhere
+// in this checkout (it lives in the core pool manager file, which this trimmed tree doesn't
+// contain), so they cannot be exercised here. macRangeSize and incrementMac are free functions and
+// are what's left to unit test in isolation.
+
+func TestMacRangeSize(t *testing.T) {
+	mustParseMac := func(s string) net.HardwareAddr {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			t.Fatalf("failed to parse test mac %s: %v", s, err)
+		}
+		return mac
+	}
+
+	cases := []struct {
+		name  string
+		start string
+		end   string
+		want  int64
+	}{
+		{name: "same address", start: "02:00:00:00:00:00", end: "02:00:00:00:00:00", want: 0},
+		{name: "adjacent addresses", start: "02:00:00:00:00:00", end: "02:00:00:00:00:01", want: 1},
+		{name: "full byte range", start: "02:00:00:00:00:00", end: "02:00:00:00:00:ff", want: 255},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := macRangeSize(mustParseMac(c.start), mustParseMac(c.end))
+			if got.Int64() != c.want {
+				t.Errorf("macRangeSize(%s, %s) = %v, want %d", c.start, c.end, got, c.want)
+			}
+		})
+	}
+}
+
+func TestIncrementMac(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "no carry", in: "02:00:00:00:00:00", want: "02:00:00:00:00:01"},
+		{name: "single byte carry", in: "02:00:00:00:00:ff", want: "02:00:00:00:01:00"},
+		{name: "carry across multiple bytes", in: "02:00:00:00:ff:ff", want: "02:00:00:01:00:00"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mac, err := net.ParseMAC(c.in)
+			if err != nil {
+				t.Fatalf("failed to parse test mac %s: %v", c.in, err)
+			}
+
+			incrementMac(mac)
+
+			if mac.String() != c.want {
+				t.Errorf("incrementMac(%s) = %s, want %s", c.in, mac.String(), c.want)
+			}
+		})
+	}
+}
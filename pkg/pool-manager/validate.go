@@ -0,0 +1,222 @@
+/*
+Copyright 2019 The KubeMacPool Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pool_manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/api/v1"
+)
+
+// MacValidationStatus classifies whether a user supplied mac address can be honoured by the
+// pool, so both the mutating and validating webhooks can agree on what is wrong with a request.
+type MacValidationStatus string
+
+const (
+	MacValidationStatusOK         MacValidationStatus = "OK"
+	MacValidationStatusConflict   MacValidationStatus = "Conflict"
+	MacValidationStatusOutOfRange MacValidationStatus = "OutOfRange"
+	MacValidationStatusMalformed  MacValidationStatus = "Malformed"
+)
+
+// podNetworkSelectionElement mirrors the fields kubemacpool cares about in a multus network
+// selection element, without taking a dependency on the multus types package.
+type podNetworkSelectionElement struct {
+	Mac string `json:"mac,omitempty"`
+}
+
+// ClassifyMacAddress tells the caller whether requestedMac is free to allocate, already taken,
+// outside the configured range, or not a valid mac address at all. An empty requestedMac is
+// always OK since the pool will pick one on allocation.
+func (p *PoolManager) ClassifyMacAddress(requestedMac string) (MacValidationStatus, error) {
+	return p.classifyMacAddressForPool(requestedMac, nil, nil)
+}
+
+// classifyMacAddressForPool is like ClassifyMacAddress, except the range check is done against
+// pool's range instead of the cluster-wide one when pool is non-nil, and requestedMac is not
+// flagged as a Conflict when it is already in ownMacs. ownMacs is the set of mac addresses the
+// object being validated already owned before this request, so that an update which merely keeps
+// an interface's existing, already-allocated mac is not rejected as a conflict with itself.
+func (p *PoolManager) classifyMacAddressForPool(requestedMac string, pool *subPool, ownMacs map[string]struct{}) (MacValidationStatus, error) {
+	if requestedMac == "" {
+		return MacValidationStatusOK, nil
+	}
+
+	parsedMac, err := net.ParseMAC(requestedMac)
+	if err != nil {
+		return MacValidationStatusMalformed, nil
+	}
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	if _, owned := ownMacs[parsedMac.String()]; !owned {
+		if _, exist := p.macPoolMap[parsedMac.String()]; exist {
+			return MacValidationStatusConflict, nil
+		}
+	}
+
+	rangeStart, rangeEnd := p.rangeStart, p.rangeEnd
+	if pool != nil {
+		rangeStart, rangeEnd = pool.rangeStart, pool.rangeEnd
+	}
+
+	if !macInRange(parsedMac, rangeStart, rangeEnd) {
+		return MacValidationStatusOutOfRange, nil
+	}
+
+	return MacValidationStatusOK, nil
+}
+
+func macInRange(mac, rangeStart, rangeEnd net.HardwareAddr) bool {
+	return bytes.Compare(mac, rangeStart) >= 0 && bytes.Compare(mac, rangeEnd) <= 0
+}
+
+// ValidatePodMacAddresses classifies every explicitly requested mac address found on pod's
+// multus network annotation against the narrowest MacPool that selects it, falling back to the
+// cluster-wide range if none does, and returns the first problem found. ownMacs is the set of mac
+// addresses pod already owned before this request (nil on create), so that an update which
+// merely keeps a network's existing, already-allocated mac is not rejected as a conflict with
+// itself.
+func (p *PoolManager) ValidatePodMacAddresses(pod *corev1.Pod, ownMacs map[string]struct{}) (MacValidationStatus, string, error) {
+	requestedMacs, err := parsePodRequestedMacs(pod)
+	if err != nil {
+		return MacValidationStatusMalformed, "failed to parse pod network annotation", err
+	}
+
+	pool, err := p.SelectPoolForPod(pod)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, requestedMac := range requestedMacs {
+		status, err := p.classifyMacAddressForPool(requestedMac, pool, ownMacs)
+		if err != nil {
+			return status, "", err
+		}
+		if status != MacValidationStatusOK {
+			return status, reasonForStatus(status, requestedMac), nil
+		}
+	}
+
+	return MacValidationStatusOK, "", nil
+}
+
+// ValidateVirtualMachineMacAddresses classifies every explicitly requested mac address on the
+// virtual machine's interfaces against the narrowest MacPool that selects it, falling back to
+// the cluster-wide range if none does, and returns the first problem found. ownMacs is the set
+// of mac addresses virtualMachine already owned before this request (nil on create), so that an
+// update which merely keeps an interface's existing, already-allocated mac is not rejected as a
+// conflict with itself.
+func (p *PoolManager) ValidateVirtualMachineMacAddresses(virtualMachine *kubevirt.VirtualMachine, ownMacs map[string]struct{}) (MacValidationStatus, string, error) {
+	pool, err := p.SelectPoolFor(virtualMachine)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, iface := range virtualMachine.Spec.Template.Spec.Domain.Devices.Interfaces {
+		status, err := p.classifyMacAddressForPool(iface.MacAddress, pool, ownMacs)
+		if err != nil {
+			return status, "", err
+		}
+		if status != MacValidationStatusOK {
+			return status, reasonForStatus(status, iface.MacAddress), nil
+		}
+	}
+
+	return MacValidationStatusOK, "", nil
+}
+
+// OwnedPodMacs returns the set of mac addresses pod's multus network annotation already
+// requests, canonicalized. Callers pass the pod's previous version (from admission's OldObject on
+// an Update request) to build the ownMacs argument for ValidatePodMacAddresses.
+func OwnedPodMacs(pod *corev1.Pod) (map[string]struct{}, error) {
+	requestedMacs, err := parsePodRequestedMacs(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	return macSet(requestedMacs), nil
+}
+
+// OwnedVirtualMachineMacs returns the set of mac addresses already assigned to virtualMachine's
+// interfaces, canonicalized. Callers pass the virtual machine's previous version (from
+// admission's OldObject on an Update request) to build the ownMacs argument for
+// ValidateVirtualMachineMacAddresses.
+func OwnedVirtualMachineMacs(virtualMachine *kubevirt.VirtualMachine) map[string]struct{} {
+	macs := make([]string, 0, len(virtualMachine.Spec.Template.Spec.Domain.Devices.Interfaces))
+	for _, iface := range virtualMachine.Spec.Template.Spec.Domain.Devices.Interfaces {
+		if iface.MacAddress != "" {
+			macs = append(macs, iface.MacAddress)
+		}
+	}
+
+	return macSet(macs)
+}
+
+func macSet(macs []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(macs))
+	for _, mac := range macs {
+		if parsedMac, err := net.ParseMAC(mac); err == nil {
+			set[parsedMac.String()] = struct{}{}
+		}
+	}
+
+	return set
+}
+
+func reasonForStatus(status MacValidationStatus, mac string) string {
+	switch status {
+	case MacValidationStatusConflict:
+		return fmt.Sprintf("mac address %s is already allocated to another interface", mac)
+	case MacValidationStatusOutOfRange:
+		return fmt.Sprintf("mac address %s is outside of the configured range", mac)
+	case MacValidationStatusMalformed:
+		return fmt.Sprintf("mac address %s is not a valid mac address", mac)
+	default:
+		return ""
+	}
+}
+
+// parsePodRequestedMacs returns the explicit mac addresses pod's multus network annotation
+// requests. The annotation also has an equally-valid comma-separated short form
+// ("net1,ns/net2"), which carries no mac addresses at all, so an annotation that isn't a JSON
+// array is simply treated as requesting no macs instead of being rejected outright.
+func parsePodRequestedMacs(pod *corev1.Pod) ([]string, error) {
+	rawNetworks, ok := pod.Annotations[NetworksAnnotation]
+	if !ok || rawNetworks == "" {
+		return nil, nil
+	}
+
+	var networkSelectionElements []podNetworkSelectionElement
+	if err := json.Unmarshal([]byte(rawNetworks), &networkSelectionElements); err != nil {
+		return nil, nil
+	}
+
+	requestedMacs := make([]string, 0, len(networkSelectionElements))
+	for _, networkSelectionElement := range networkSelectionElements {
+		if networkSelectionElement.Mac != "" {
+			requestedMacs = append(requestedMacs, networkSelectionElement.Mac)
+		}
+	}
+
+	return requestedMacs, nil
+}
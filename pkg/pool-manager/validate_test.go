@@ -0,0 +1,135 @@
+/*
+Copyright 2019 The KubeMacPool Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pool_manager
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirt "kubevirt.io/client-go/api/v1"
+)
+
+// ClassifyMacAddress, classifyMacAddressForPool, ValidatePodMacAddresses and
+// ValidateVirtualMachineMacAddresses are all methods on *PoolManager, whose struct is not defined
+// anywhere in this checkout (it lives in the core pool manager file, which this trimmed tree
+// doesn't contain), so they cannot be exercised here. OwnedVirtualMachineMacs, OwnedPodMacs and
+// the free-standing helpers they build on are what's left to unit test in isolation.
+
+func TestOwnedVirtualMachineMacs(t *testing.T) {
+	vm := &kubevirt.VirtualMachine{
+		Spec: kubevirt.VirtualMachineSpec{
+			Template: &kubevirt.VirtualMachineInstanceTemplateSpec{
+				Spec: kubevirt.VirtualMachineInstanceSpec{
+					Domain: kubevirt.DomainSpec{
+						Devices: kubevirt.Devices{
+							Interfaces: []kubevirt.Interface{
+								{Name: "net1", MacAddress: "AA:AA:AA:AA:AA:AA"},
+								{Name: "net2"},
+								{Name: "net3", MacAddress: "bb:bb:bb:bb:bb:bb"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	got := OwnedVirtualMachineMacs(vm)
+	want := map[string]struct{}{
+		"aa:aa:aa:aa:aa:aa": {},
+		"bb:bb:bb:bb:bb:bb": {},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("OwnedVirtualMachineMacs() = %v, want %v", got, want)
+	}
+}
+
+func TestOwnedPodMacs(t *testing.T) {
+	cases := []struct {
+		name string
+		pod  *corev1.Pod
+		want map[string]struct{}
+	}{
+		{
+			name: "json array form with macs",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+				NetworksAnnotation: `[{"name":"net1","mac":"AA:AA:AA:AA:AA:AA"},{"name":"net2"}]`,
+			}}},
+			want: map[string]struct{}{"aa:aa:aa:aa:aa:aa": {}},
+		},
+		{
+			name: "short form carries no macs",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+				NetworksAnnotation: "net1,ns/net2",
+			}}},
+			want: map[string]struct{}{},
+		},
+		{
+			name: "no annotation",
+			pod:  &corev1.Pod{},
+			want: map[string]struct{}{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := OwnedPodMacs(c.pod)
+			if err != nil {
+				t.Fatalf("OwnedPodMacs() returned error: %v", err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("OwnedPodMacs() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestMacInRange(t *testing.T) {
+	mustParseMac := func(s string) net.HardwareAddr {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			t.Fatalf("failed to parse test mac %s: %v", s, err)
+		}
+		return mac
+	}
+
+	rangeStart := mustParseMac("02:00:00:00:00:00")
+	rangeEnd := mustParseMac("02:00:00:00:00:ff")
+
+	cases := []struct {
+		name string
+		mac  string
+		want bool
+	}{
+		{name: "start of range", mac: "02:00:00:00:00:00", want: true},
+		{name: "end of range", mac: "02:00:00:00:00:ff", want: true},
+		{name: "middle of range", mac: "02:00:00:00:00:7f", want: true},
+		{name: "below range", mac: "01:ff:ff:ff:ff:ff", want: false},
+		{name: "above range", mac: "02:00:00:00:01:00", want: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := macInRange(mustParseMac(c.mac), rangeStart, rangeEnd); got != c.want {
+				t.Errorf("macInRange(%s) = %v, want %v", c.mac, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2019 The KubeMacPool Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package patchutil builds json patches for the subset of fields a kubemacpool webhook is
+// allowed to mutate, so the pod, virtual machine and virtual machine instance webhooks don't each
+// have to reimplement the same original/current diffing.
+package patchutil
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"gomodules.xyz/jsonpatch/v2"
+	admissionv1 "k8s.io/api/admission/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// FieldChange describes a single field kubemacpool is allowed to mutate: the JSON-pointer path it
+// lives at in the object, and its value before and after the webhook's own changes.
+type FieldChange struct {
+	Path     string
+	Original interface{}
+	Current  interface{}
+}
+
+// BuildPatches diffs each FieldChange's original and current value and returns the json patch
+// operations needed to apply just those changes, with the path rewritten to the field's own
+// JSON-pointer. Fields whose value did not change produce no operation.
+func BuildPatches(changes []FieldChange) ([]jsonpatch.Operation, error) {
+	var patches []jsonpatch.Operation
+
+	for _, change := range changes {
+		marshaledOriginal, _ := json.Marshal(change.Original)
+		marshaledCurrent, _ := json.Marshal(change.Current)
+
+		fieldPatches, err := jsonpatch.CreatePatch(marshaledOriginal, marshaledCurrent)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to patch change at %s", change.Path)
+		}
+
+		for idx := range fieldPatches {
+			fieldPatches[idx].Path = change.Path
+		}
+
+		patches = append(patches, fieldPatches...)
+	}
+
+	return patches, nil
+}
+
+// Response builds an allowed admission.Response out of the given patches, using the
+// admission/v1 PatchType so it can be returned directly from a webhook's Handle method.
+func Response(patches []jsonpatch.Operation) admission.Response {
+	return admission.Response{
+		Patches: patches,
+		AdmissionResponse: admissionv1.AdmissionResponse{
+			Allowed:   true,
+			PatchType: func() *admissionv1.PatchType { pt := admissionv1.PatchTypeJSONPatch; return &pt }(),
+		},
+	}
+}
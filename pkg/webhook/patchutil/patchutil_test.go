@@ -0,0 +1,104 @@
+/*
+Copyright 2019 The KubeMacPool Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package patchutil
+
+import (
+	"testing"
+
+	"gomodules.xyz/jsonpatch/v2"
+)
+
+func TestBuildPatches(t *testing.T) {
+	cases := []struct {
+		name    string
+		changes []FieldChange
+		want    int
+	}{
+		{
+			name: "unchanged field produces no patch",
+			changes: []FieldChange{
+				{Path: "/metadata/annotations/foo", Original: "same", Current: "same"},
+			},
+			want: 0,
+		},
+		{
+			name: "changed string field produces one replace op",
+			changes: []FieldChange{
+				{Path: "/spec/mac", Original: "", Current: "aa:aa:aa:aa:aa:aa"},
+			},
+			want: 1,
+		},
+		{
+			name: "multiple independent field changes accumulate",
+			changes: []FieldChange{
+				{Path: "/spec/mac1", Original: "", Current: "aa:aa:aa:aa:aa:aa"},
+				{Path: "/spec/mac2", Original: "", Current: "bb:bb:bb:bb:bb:bb"},
+			},
+			want: 2,
+		},
+		{
+			name:    "no changes at all",
+			changes: nil,
+			want:    0,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			patches, err := BuildPatches(c.changes)
+			if err != nil {
+				t.Fatalf("BuildPatches() returned error: %v", err)
+			}
+			if len(patches) != c.want {
+				t.Errorf("BuildPatches() returned %d patches, want %d (%v)", len(patches), c.want, patches)
+			}
+			for _, p := range patches {
+				if p.Path == "" {
+					t.Errorf("patch operation has empty path: %+v", p)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildPatchesRewritesPathToFieldChangePath(t *testing.T) {
+	changes := []FieldChange{
+		{Path: "/spec/mac", Original: "", Current: "aa:aa:aa:aa:aa:aa"},
+	}
+
+	patches, err := BuildPatches(changes)
+	if err != nil {
+		t.Fatalf("BuildPatches() returned error: %v", err)
+	}
+	if len(patches) != 1 {
+		t.Fatalf("expected exactly one patch, got %d: %v", len(patches), patches)
+	}
+	if patches[0].Path != "/spec/mac" {
+		t.Errorf("patch path = %q, want %q", patches[0].Path, "/spec/mac")
+	}
+}
+
+func TestResponseIsAllowedWithJSONPatchType(t *testing.T) {
+	resp := Response([]jsonpatch.Operation{{Operation: "replace", Path: "/spec/mac", Value: "aa:aa:aa:aa:aa:aa"}})
+
+	if !resp.Allowed {
+		t.Error("Response() should always be Allowed")
+	}
+	if resp.PatchType == nil || *resp.PatchType != "JSONPatch" {
+		t.Errorf("PatchType = %v, want JSONPatch", resp.PatchType)
+	}
+}
@@ -19,17 +19,20 @@ package pod
 import (
 	"context"
 	"net/http"
+	"time"
 
 	webhookserver "github.com/qinqon/kube-admission-webhook/pkg/webhook/server"
 	"gomodules.xyz/jsonpatch/v2"
-	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
+	"github.com/k8snetworkplumbingwg/kubemacpool/pkg/metrics"
 	"github.com/k8snetworkplumbingwg/kubemacpool/pkg/pool-manager"
+	"github.com/k8snetworkplumbingwg/kubemacpool/pkg/webhook/patchutil"
 )
 
 var log = logf.Log.WithName("Webhook mutatepods")
@@ -38,11 +41,12 @@ type podAnnotator struct {
 	client      client.Client
 	decoder     *admission.Decoder
 	poolManager *pool_manager.PoolManager
+	recorder    record.EventRecorder
 }
 
 // Add adds server modifiers to the server, like registering the hook to the webhook server.
-func Add(s *webhookserver.Server, poolManager *pool_manager.PoolManager) error {
-	podAnnotator := &podAnnotator{poolManager: poolManager}
+func Add(s *webhookserver.Server, poolManager *pool_manager.PoolManager, recorder record.EventRecorder) error {
+	podAnnotator := &podAnnotator{poolManager: poolManager, recorder: recorder}
 	s.UpdateOpts(webhookserver.WithHook("/mutate-pods", &webhook.Admission{Handler: podAnnotator}))
 	return nil
 }
@@ -64,11 +68,25 @@ func (a *podAnnotator) Handle(ctx context.Context, req admission.Request) admiss
 	transactionTimestamp := pool_manager.CreateTransactionTimestamp()
 	log.V(1).Info("got a create pod event", "podName", pod.Name, "podNamespace", pod.Namespace, "transactionTimestamp", transactionTimestamp)
 
-	err = a.poolManager.AllocatePodMac(pod)
+	pool, err := a.poolManager.SelectPoolForPod(pod)
 	if err != nil {
 		return admission.Errored(http.StatusInternalServerError, err)
 	}
 
+	allocationStart := time.Now()
+	if pool != nil {
+		err = a.poolManager.AllocatePodMacFromPool(pod, pool)
+	} else {
+		err = a.poolManager.AllocatePodMac(pod)
+	}
+	metrics.ObserveAllocationDuration(allocationStart)
+	if err != nil {
+		metrics.IncAllocationFailure("InternalError")
+		a.recorder.Eventf(originalPod, corev1.EventTypeWarning, metrics.ReasonMacConflict, "failed to allocate mac address: %v", err)
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	a.recorder.Event(originalPod, corev1.EventTypeNormal, metrics.ReasonMacAllocated, "mac address allocated by kubemacpool")
+
 	// admission.PatchResponse generates a Response containing patches.
 	return patchPodChanges(originalPod, pod)
 }
@@ -85,13 +103,7 @@ func patchPodChanges(originalPod, currentPod *corev1.Pod) admission.Response {
 	}
 
 	log.Info("patchPodChanges", "kubemapcoolJsonPatches", kubemapcoolJsonPatches)
-	return admission.Response{
-		Patches: kubemapcoolJsonPatches,
-		AdmissionResponse: admissionv1beta1.AdmissionResponse{
-			Allowed:   true,
-			PatchType: func() *admissionv1beta1.PatchType { pt := admissionv1beta1.PatchTypeJSONPatch; return &pt }(),
-		},
-	}
+	return patchutil.Response(kubemapcoolJsonPatches)
 }
 
 // InjectClient injects the client into the podAnnotator
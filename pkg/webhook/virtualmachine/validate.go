@@ -0,0 +1,97 @@
+/*
+Copyright 2019 The KubeMacPool Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package virtualmachine
+
+import (
+	"context"
+	"net/http"
+
+	webhookserver "github.com/qinqon/kube-admission-webhook/pkg/webhook/server"
+	admissionv1 "k8s.io/api/admission/v1"
+	kubevirt "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/k8snetworkplumbingwg/kubemacpool/pkg/metrics"
+	"github.com/k8snetworkplumbingwg/kubemacpool/pkg/pool-manager"
+)
+
+var validateLog = logf.Log.WithName("Webhook validatevirtualmachines")
+
+type virtualMachineValidator struct {
+	client      client.Client
+	decoder     *admission.Decoder
+	poolManager *pool_manager.PoolManager
+}
+
+// AddValidate adds server modifiers to the server, like registering the validating hook to the webhook server.
+func AddValidate(s *webhookserver.Server, poolManager *pool_manager.PoolManager) error {
+	virtualMachineValidator := &virtualMachineValidator{poolManager: poolManager}
+	s.UpdateOpts(webhookserver.WithHook("/validate-virtualmachines", &webhook.Admission{Handler: virtualMachineValidator}))
+	return nil
+}
+
+// Handle rejects virtual machines whose explicitly requested mac addresses conflict with the
+// pool, fall outside of it, or are malformed, instead of letting AllocateVirtualMachineMac fail
+// with an InternalError.
+func (v *virtualMachineValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	virtualMachine := &kubevirt.VirtualMachine{}
+
+	err := v.decoder.Decode(req, virtualMachine)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	// ownMacs holds the mac addresses virtualMachine already had before this request, so an
+	// update that merely keeps an interface's existing, already-allocated mac is not rejected as
+	// a conflict with itself.
+	var ownMacs map[string]struct{}
+	if req.AdmissionRequest.Operation == admissionv1.Update {
+		previousVirtualMachine := &kubevirt.VirtualMachine{}
+		if err := v.decoder.DecodeRaw(req.AdmissionRequest.OldObject, previousVirtualMachine); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		ownMacs = pool_manager.OwnedVirtualMachineMacs(previousVirtualMachine)
+	}
+
+	status, reason, err := v.poolManager.ValidateVirtualMachineMacAddresses(virtualMachine, ownMacs)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	if status != pool_manager.MacValidationStatusOK {
+		metrics.IncAllocationFailure(string(status))
+		validateLog.V(1).Info("denying virtual machine", "virtualMachineFullName", pool_manager.VmNamespaced(virtualMachine), "reason", reason)
+		return admission.Denied(reason)
+	}
+
+	return admission.Allowed("")
+}
+
+// InjectClient injects the client into the virtualMachineValidator
+func (v *virtualMachineValidator) InjectClient(c client.Client) error {
+	v.client = c
+	return nil
+}
+
+// InjectDecoder injects the decoder.
+func (v *virtualMachineValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
@@ -18,26 +18,30 @@ package virtualmachine
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"reflect"
+	"time"
 
 	"github.com/go-logr/logr"
 	helper "github.com/k8snetworkplumbingwg/kubemacpool/pkg/utils"
 	"github.com/pkg/errors"
 	webhookserver "github.com/qinqon/kube-admission-webhook/pkg/webhook/server"
 	"gomodules.xyz/jsonpatch/v2"
-	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
 	kubevirt "kubevirt.io/client-go/api/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
+	"github.com/k8snetworkplumbingwg/kubemacpool/pkg/metrics"
 	"github.com/k8snetworkplumbingwg/kubemacpool/pkg/pool-manager"
+	"github.com/k8snetworkplumbingwg/kubemacpool/pkg/webhook/patchutil"
 )
 
 var log = logf.Log.WithName("Webhook mutatevirtualmachines")
@@ -46,11 +50,12 @@ type virtualMachineAnnotator struct {
 	client      client.Client
 	decoder     *admission.Decoder
 	poolManager *pool_manager.PoolManager
+	recorder    record.EventRecorder
 }
 
 // Add adds server modifiers to the server, like registering the hook to the webhook server.
-func Add(s *webhookserver.Server, poolManager *pool_manager.PoolManager) error {
-	virtualMachineAnnotator := &virtualMachineAnnotator{poolManager: poolManager}
+func Add(s *webhookserver.Server, poolManager *pool_manager.PoolManager, recorder record.EventRecorder) error {
+	virtualMachineAnnotator := &virtualMachineAnnotator{poolManager: poolManager, recorder: recorder}
 	s.UpdateOpts(webhookserver.WithHook("/mutate-virtualmachines", &webhook.Admission{Handler: virtualMachineAnnotator}))
 	return nil
 }
@@ -77,15 +82,24 @@ func (a *virtualMachineAnnotator) Handle(ctx context.Context, req admission.Requ
 
 	logger.V(1).Info("got a virtual machine event")
 
-	if req.AdmissionRequest.Operation == admissionv1beta1.Create {
+	allocationStart := time.Now()
+
+	if req.AdmissionRequest.Operation == admissionv1.Create {
 		err = a.mutateCreateVirtualMachinesFn(virtualMachine, logger)
+		metrics.ObserveAllocationDuration(allocationStart)
 		if err != nil {
+			metrics.IncAllocationFailure("InternalError")
+			a.recorder.Eventf(originalVirtualMachine, corev1.EventTypeWarning, metrics.ReasonMacConflict, "failed to allocate mac address: %v", err)
 			return admission.Errored(http.StatusInternalServerError,
 				fmt.Errorf("Failed to create virtual machine allocation error: %v", err))
 		}
-	} else if req.AdmissionRequest.Operation == admissionv1beta1.Update {
+		a.recorder.Event(originalVirtualMachine, corev1.EventTypeNormal, metrics.ReasonMacAllocated, "mac address allocated by kubemacpool")
+	} else if req.AdmissionRequest.Operation == admissionv1.Update {
 		err = a.mutateUpdateVirtualMachinesFn(virtualMachine, logger)
+		metrics.ObserveAllocationDuration(allocationStart)
 		if err != nil {
+			metrics.IncAllocationFailure("InternalError")
+			a.recorder.Eventf(originalVirtualMachine, corev1.EventTypeWarning, metrics.ReasonMacConflict, "failed to update mac address allocation: %v", err)
 			return admission.Errored(http.StatusInternalServerError,
 				fmt.Errorf("Failed to update virtual machine allocation error: %v", err))
 		}
@@ -108,43 +122,29 @@ func patchVMChanges(originalVirtualMachine, currentVirtualMachine *kubevirt.Virt
 			kubemapcoolJsonPatches = append(kubemapcoolJsonPatches, transactionTimestampAnnotationPatch)
 		}
 
-		for ifaceIdx, _ := range currentVirtualMachine.Spec.Template.Spec.Domain.Devices.Interfaces {
-			interfacePatches, err := patchChange(fmt.Sprintf("/spec/template/spec/domain/devices/interfaces/%d/macAddress", ifaceIdx), originalVirtualMachine.Spec.Template.Spec.Domain.Devices.Interfaces[ifaceIdx].MacAddress, currentVirtualMachine.Spec.Template.Spec.Domain.Devices.Interfaces[ifaceIdx].MacAddress)
-			if err != nil {
-				return admission.Errored(http.StatusInternalServerError, err)
-			}
-			kubemapcoolJsonPatches = append(kubemapcoolJsonPatches, interfacePatches...)
+		var fieldChanges []patchutil.FieldChange
+		for ifaceIdx := range currentVirtualMachine.Spec.Template.Spec.Domain.Devices.Interfaces {
+			fieldChanges = append(fieldChanges, patchutil.FieldChange{
+				Path:     fmt.Sprintf("/spec/template/spec/domain/devices/interfaces/%d/macAddress", ifaceIdx),
+				Original: originalVirtualMachine.Spec.Template.Spec.Domain.Devices.Interfaces[ifaceIdx].MacAddress,
+				Current:  currentVirtualMachine.Spec.Template.Spec.Domain.Devices.Interfaces[ifaceIdx].MacAddress,
+			})
 		}
+		fieldChanges = append(fieldChanges, patchutil.FieldChange{
+			Path:     "/metadata/finalizers",
+			Original: originalVirtualMachine.ObjectMeta.Finalizers,
+			Current:  currentVirtualMachine.ObjectMeta.Finalizers,
+		})
 
-		finalizerPatches, err := patchChange("/metadata/finalizers", originalVirtualMachine.ObjectMeta.Finalizers, currentVirtualMachine.ObjectMeta.Finalizers)
+		fieldPatches, err := patchutil.BuildPatches(fieldChanges)
 		if err != nil {
 			return admission.Errored(http.StatusInternalServerError, err)
 		}
-		kubemapcoolJsonPatches = append(kubemapcoolJsonPatches, finalizerPatches...)
+		kubemapcoolJsonPatches = append(kubemapcoolJsonPatches, fieldPatches...)
 	}
 
 	logger.Info("patchVMChanges", "kubemapcoolJsonPatches", kubemapcoolJsonPatches)
-	return admission.Response{
-		Patches: kubemapcoolJsonPatches,
-		AdmissionResponse: admissionv1beta1.AdmissionResponse{
-			Allowed:   true,
-			PatchType: func() *admissionv1beta1.PatchType { pt := admissionv1beta1.PatchTypeJSONPatch; return &pt }(),
-		},
-	}
-}
-
-func patchChange(pathChange string, original, current interface{}) ([]jsonpatch.Operation, error) {
-	marshaledOriginal, _ := json.Marshal(original)
-	marshaledCurrent, _ := json.Marshal(current)
-	patches, err := jsonpatch.CreatePatch(marshaledOriginal, marshaledCurrent)
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to patch change")
-	}
-	for idx, _ := range patches {
-		patches[idx].Path = pathChange
-	}
-
-	return patches, nil
+	return patchutil.Response(kubemapcoolJsonPatches)
 }
 
 // mutateCreateVirtualMachinesFn calls the create allocation function
@@ -161,7 +161,15 @@ func (a *virtualMachineAnnotator) mutateCreateVirtualMachinesFn(virtualMachine *
 		if apierrors.IsNotFound(err) {
 			if !pool_manager.IsVirtualMachineDeletionInProgress(virtualMachine) {
 				// If the object is not being deleted, then lets allocate macs and add the finalizer
-				err = a.poolManager.AllocateVirtualMachineMac(virtualMachine, &transactionTimestamp, logger)
+				pool, err := a.poolManager.SelectPoolFor(virtualMachine)
+				if err != nil {
+					return errors.Wrap(err, "Failed to select a MacPool for the vm object")
+				}
+				if pool != nil {
+					err = a.poolManager.AllocateVirtualMachineMacFromPool(virtualMachine, pool, &transactionTimestamp, logger)
+				} else {
+					err = a.poolManager.AllocateVirtualMachineMac(virtualMachine, &transactionTimestamp, logger)
+				}
 				if err != nil {
 					return errors.Wrap(err, "Failed to allocate mac to the vm object")
 				}
@@ -197,8 +205,43 @@ func (a *virtualMachineAnnotator) mutateUpdateVirtualMachinesFn(virtualMachine *
 		pool_manager.SetTransactionTimestampAnnotationToVm(virtualMachine, transactionTimestamp)
 
 		if isVirtualMachineInterfacesChanged(previousVirtualMachine, virtualMachine) {
-			return a.poolManager.UpdateMacAddressesForVirtualMachine(previousVirtualMachine, virtualMachine, &transactionTimestamp, logger)
+			return a.allocateOrReleaseHotplugMacs(previousVirtualMachine, virtualMachine, transactionTimestamp, logger)
+		}
+	}
+
+	return nil
+}
+
+// allocateOrReleaseHotplugMacs reacts to KubeVirt hot-adding or hot-removing network interfaces
+// on a running VM by allocating mac addresses only for the newly added interfaces and releasing
+// the mac addresses of the removed ones, leaving the rest of the VM's allocations untouched.
+// Interfaces are matched by name; if none was added or removed, it falls back to the regular
+// update path.
+func (a *virtualMachineAnnotator) allocateOrReleaseHotplugMacs(previousVirtualMachine, virtualMachine *kubevirt.VirtualMachine, transactionTimestamp time.Time, logger logr.Logger) error {
+	currentInterfaces := virtualMachine.Spec.Template.Spec.Domain.Devices.Interfaces
+	addedIdx, removedInterfaces := pool_manager.DiffInterfaces(previousVirtualMachine.Spec.Template.Spec.Domain.Devices.Interfaces, currentInterfaces)
+
+	if len(addedIdx) == 0 && len(removedInterfaces) == 0 {
+		return a.poolManager.UpdateMacAddressesForVirtualMachine(previousVirtualMachine, virtualMachine, &transactionTimestamp, logger)
+	}
+
+	if len(addedIdx) > 0 {
+		ownMacs := pool_manager.OwnedVirtualMachineMacs(previousVirtualMachine)
+		logger.Info("allocating mac addresses for hotplugged interfaces", "addedInterfaces", len(addedIdx))
+		if err := a.poolManager.AllocateHotplugInterfaceMac(virtualMachine, currentInterfaces, addedIdx, ownMacs, &transactionTimestamp, logger); err != nil {
+			metrics.IncAllocationFailure("InternalError")
+			a.recorder.Eventf(virtualMachine, corev1.EventTypeWarning, metrics.ReasonMacConflict, "failed to allocate mac address for hotplugged interface: %v", err)
+			return errors.Wrap(err, "Failed to allocate mac to hotplugged interfaces")
+		}
+		a.recorder.Eventf(virtualMachine, corev1.EventTypeNormal, metrics.ReasonMacAllocated, "mac address allocated for %d hotplugged interface(s)", len(addedIdx))
+	}
+
+	if len(removedInterfaces) > 0 {
+		logger.Info("releasing mac addresses for unplugged interfaces", "removedInterfaces", len(removedInterfaces))
+		if err := a.poolManager.ReleaseHotplugInterfaceMacs(virtualMachine, removedInterfaces, logger); err != nil {
+			return errors.Wrap(err, "Failed to release mac from unplugged interfaces")
 		}
+		a.recorder.Eventf(virtualMachine, corev1.EventTypeNormal, metrics.ReasonMacReleased, "mac address released for %d unplugged interface(s)", len(removedInterfaces))
 	}
 
 	return nil
@@ -0,0 +1,190 @@
+/*
+Copyright 2019 The KubeMacPool Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package virtualmachineinstance
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	webhookserver "github.com/qinqon/kube-admission-webhook/pkg/webhook/server"
+	"gomodules.xyz/jsonpatch/v2"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
+	kubevirt "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/k8snetworkplumbingwg/kubemacpool/pkg/metrics"
+	"github.com/k8snetworkplumbingwg/kubemacpool/pkg/pool-manager"
+	"github.com/k8snetworkplumbingwg/kubemacpool/pkg/webhook/patchutil"
+)
+
+var log = logf.Log.WithName("Webhook mutatevirtualmachineinstances")
+
+type virtualMachineInstanceAnnotator struct {
+	client      client.Client
+	decoder     *admission.Decoder
+	poolManager *pool_manager.PoolManager
+	recorder    record.EventRecorder
+}
+
+// Add adds server modifiers to the server, like registering the hook to the webhook server.
+func Add(s *webhookserver.Server, poolManager *pool_manager.PoolManager, recorder record.EventRecorder) error {
+	virtualMachineInstanceAnnotator := &virtualMachineInstanceAnnotator{poolManager: poolManager, recorder: recorder}
+	s.UpdateOpts(webhookserver.WithHook("/mutate-virtualmachineinstances", &webhook.Admission{Handler: virtualMachineInstanceAnnotator}))
+	return nil
+}
+
+// Handle reacts to KubeVirt hot-plugging or hot-unplugging network interfaces directly on a
+// running VirtualMachineInstance, allocating or releasing mac addresses only for the delta.
+func (a *virtualMachineInstanceAnnotator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	virtualMachineInstance := &kubevirt.VirtualMachineInstance{}
+
+	err := a.decoder.Decode(req, virtualMachineInstance)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	originalVirtualMachineInstance := virtualMachineInstance.DeepCopy()
+
+	logger := log.WithName("Handle").WithValues("virtualMachineInstanceFullName", pool_manager.VmiNamespaced(virtualMachineInstance))
+	logger.V(1).Info("got a virtual machine instance event")
+
+	if req.AdmissionRequest.Operation == admissionv1.Update {
+		allocationStart := time.Now()
+		err := a.mutateUpdateVirtualMachineInstanceFn(virtualMachineInstance, logger)
+		metrics.ObserveAllocationDuration(allocationStart)
+		if err != nil {
+			metrics.IncAllocationFailure("InternalError")
+			a.recorder.Eventf(originalVirtualMachineInstance, corev1.EventTypeWarning, metrics.ReasonMacConflict, "failed to update mac address allocation: %v", err)
+			return admission.Errored(http.StatusInternalServerError,
+				fmt.Errorf("Failed to update virtual machine instance allocation error: %v", err))
+		}
+	}
+
+	return patchVirtualMachineInstanceChanges(originalVirtualMachineInstance, virtualMachineInstance, logger)
+}
+
+// mutateUpdateVirtualMachineInstanceFn allocates mac addresses for newly hotplugged interfaces
+// and releases mac addresses for unplugged ones, leaving the rest of the VMI's interfaces intact.
+func (a *virtualMachineInstanceAnnotator) mutateUpdateVirtualMachineInstanceFn(virtualMachineInstance *kubevirt.VirtualMachineInstance, parentLogger logr.Logger) error {
+	logger := parentLogger.WithName("mutateUpdateVirtualMachineInstanceFn")
+	previousVirtualMachineInstance := &kubevirt.VirtualMachineInstance{}
+	err := a.client.Get(context.TODO(), client.ObjectKey{Namespace: virtualMachineInstance.Namespace, Name: virtualMachineInstance.Name}, previousVirtualMachineInstance)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if !isVirtualMachineInstanceInterfacesChanged(previousVirtualMachineInstance, virtualMachineInstance) {
+		return nil
+	}
+
+	transactionTimestamp := pool_manager.CreateTransactionTimestamp()
+	currentInterfaces := virtualMachineInstance.Spec.Domain.Devices.Interfaces
+	addedIdx, removedInterfaces := pool_manager.DiffInterfaces(previousVirtualMachineInstance.Spec.Domain.Devices.Interfaces, currentInterfaces)
+
+	if len(addedIdx) > 0 {
+		// A hot-added interface on the owning VirtualMachine is propagated here by KubeVirt with
+		// its mac already filled in, so it must not be re-validated against macPoolMap as if it
+		// were a fresh request: look up the owning VM's own macs first.
+		var ownMacs map[string]struct{}
+		ownerVirtualMachine := &kubevirt.VirtualMachine{}
+		err := a.client.Get(context.TODO(), client.ObjectKey{Namespace: virtualMachineInstance.Namespace, Name: virtualMachineInstance.Name}, ownerVirtualMachine)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "Failed to get the owning virtual machine")
+		}
+		if err == nil {
+			ownMacs = pool_manager.OwnedVirtualMachineMacs(ownerVirtualMachine)
+		}
+
+		logger.Info("allocating mac addresses for hotplugged interfaces", "addedInterfaces", len(addedIdx))
+		if err := a.poolManager.AllocateHotplugInterfaceMac(virtualMachineInstance, currentInterfaces, addedIdx, ownMacs, &transactionTimestamp, logger); err != nil {
+			return errors.Wrap(err, "Failed to allocate mac to hotplugged interfaces")
+		}
+		a.recorder.Eventf(virtualMachineInstance, corev1.EventTypeNormal, metrics.ReasonMacAllocated, "mac address allocated for %d hotplugged interface(s)", len(addedIdx))
+	}
+
+	if len(removedInterfaces) > 0 {
+		logger.Info("releasing mac addresses for unplugged interfaces", "removedInterfaces", len(removedInterfaces))
+		if err := a.poolManager.ReleaseHotplugInterfaceMacs(virtualMachineInstance, removedInterfaces, logger); err != nil {
+			return errors.Wrap(err, "Failed to release mac from unplugged interfaces")
+		}
+		a.recorder.Eventf(virtualMachineInstance, corev1.EventTypeNormal, metrics.ReasonMacReleased, "mac address released for %d unplugged interface(s)", len(removedInterfaces))
+	}
+
+	return nil
+}
+
+// isVirtualMachineInstanceInterfacesChanged checks if the vmi interfaces changed in this
+// webhook update request.
+func isVirtualMachineInstanceInterfacesChanged(previousVirtualMachineInstance, virtualMachineInstance *kubevirt.VirtualMachineInstance) bool {
+	return !reflect.DeepEqual(previousVirtualMachineInstance.Spec.Domain.Devices.Interfaces, virtualMachineInstance.Spec.Domain.Devices.Interfaces)
+}
+
+// create jsonpatches only to changed caused by the kubemacpool webhook changes
+func patchVirtualMachineInstanceChanges(originalVirtualMachineInstance, currentVirtualMachineInstance *kubevirt.VirtualMachineInstance, parentLogger logr.Logger) admission.Response {
+	logger := parentLogger.WithName("patchVirtualMachineInstanceChanges")
+	var kubemapcoolJsonPatches []jsonpatch.Operation
+
+	originalTransactionTSString := originalVirtualMachineInstance.GetAnnotations()[pool_manager.TransactionTimestampAnnotation]
+	currentTransactionTSString := currentVirtualMachineInstance.GetAnnotations()[pool_manager.TransactionTimestampAnnotation]
+	if originalTransactionTSString != currentTransactionTSString {
+		transactionTimestampAnnotationPatch := jsonpatch.NewPatch("add", "/metadata/annotations", map[string]string{pool_manager.TransactionTimestampAnnotation: currentTransactionTSString})
+		kubemapcoolJsonPatches = append(kubemapcoolJsonPatches, transactionTimestampAnnotationPatch)
+	}
+
+	var fieldChanges []patchutil.FieldChange
+	for ifaceIdx := range currentVirtualMachineInstance.Spec.Domain.Devices.Interfaces {
+		fieldChanges = append(fieldChanges, patchutil.FieldChange{
+			Path:     fmt.Sprintf("/spec/domain/devices/interfaces/%d/macAddress", ifaceIdx),
+			Original: originalVirtualMachineInstance.Spec.Domain.Devices.Interfaces[ifaceIdx].MacAddress,
+			Current:  currentVirtualMachineInstance.Spec.Domain.Devices.Interfaces[ifaceIdx].MacAddress,
+		})
+	}
+
+	fieldPatches, err := patchutil.BuildPatches(fieldChanges)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	kubemapcoolJsonPatches = append(kubemapcoolJsonPatches, fieldPatches...)
+
+	logger.Info("patchVirtualMachineInstanceChanges", "kubemapcoolJsonPatches", kubemapcoolJsonPatches)
+	return patchutil.Response(kubemapcoolJsonPatches)
+}
+
+// InjectClient injects the client into the virtualMachineInstanceAnnotator
+func (a *virtualMachineInstanceAnnotator) InjectClient(c client.Client) error {
+	a.client = c
+	return nil
+}
+
+// InjectDecoder injects the decoder.
+func (a *virtualMachineInstanceAnnotator) InjectDecoder(d *admission.Decoder) error {
+	a.decoder = d
+	return nil
+}